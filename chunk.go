@@ -2,22 +2,78 @@ package main
 
 import (
 	"fmt"
-	"io"
-	"io/ioutil"
 	"math"
-	"os"
-	"path/filepath"
-	"strconv"
+	"sort"
+	"sync"
 	"time"
 
 	. "github.com/claudetech/loggo/default"
 )
 
-// ChunkManager manages chunks on disk
+// chunkDownloader is the subset of *DownloadManager that ChunkManager relies
+// on; depending on the interface rather than the concrete type lets tests
+// exercise RequestChunk/fetchChunk without a real DownloadManager.
+type chunkDownloader interface {
+	RequestChunk(req *ChunkRequest) *ChunkResponse
+}
+
+// ChunkManager manages chunks, backed by a pluggable ChunkStore
 type ChunkManager struct {
-	ChunkPath       string
-	ChunkSize       int64
-	downloadManager *DownloadManager
+	ChunkSize         int64
+	MaxCacheSize      int64
+	PreloadWindowSize int
+	PreloadThreshold  int
+	store             ChunkStore
+	downloadManager   chunkDownloader
+
+	cacheMu    sync.Mutex
+	cacheIndex map[string]*chunkCacheEntry
+	cacheSize  int64
+	pinned     map[string]int
+	stats      ChunkManagerStats
+
+	patternMu  sync.Mutex
+	patterns   map[string]*readerPattern
+	preloadMu  sync.Mutex
+	preloading map[string]bool
+
+	sfMu     sync.Mutex
+	inflight map[string]*sharedChunkOp
+}
+
+// sharedChunkOp lets concurrent misses for the same chunk id share a single
+// download instead of each issuing their own request
+type sharedChunkOp struct {
+	done chan struct{}
+	res  *ChunkResponse
+}
+
+// readerPattern tracks the recent access history for a single object so that
+// sequential (read-ahead friendly) access can be told apart from random access
+type readerPattern struct {
+	hasLastOffset   bool
+	lastOffsetStart int64
+	sequentialHits  int
+	lastAccess      time.Time
+}
+
+// maxTrackedPatterns bounds the number of objects ChunkManager keeps reader
+// patterns for; once full, the least recently accessed entry is evicted to
+// make room, the same way chunk cache entries are evicted by ensureSpace.
+const maxTrackedPatterns = 4096
+
+// chunkCacheEntry describes a single cached chunk in the store
+type chunkCacheEntry struct {
+	size  int64
+	mtime time.Time
+}
+
+// ChunkManagerStats holds cache accounting counters for the chunk cache
+type ChunkManagerStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Bytes     int64
 }
 
 type ChunkRequest struct {
@@ -36,10 +92,10 @@ type ChunkResponse struct {
 	Bytes []byte
 }
 
-// NewChunkManager creates a new chunk manager
-func NewChunkManager(downloadManager *DownloadManager, chunkPath string, chunkSize int64) (*ChunkManager, error) {
-	if "" == chunkPath {
-		return nil, fmt.Errorf("Path to chunk file must not be empty")
+// NewChunkManager creates a new chunk manager backed by store
+func NewChunkManager(downloadManager chunkDownloader, store ChunkStore, chunkSize, maxCacheSize int64) (*ChunkManager, error) {
+	if nil == store {
+		return nil, fmt.Errorf("Chunk store must not be nil")
 	}
 	if chunkSize < 4096 {
 		return nil, fmt.Errorf("Chunk size must not be < 4096")
@@ -49,14 +105,105 @@ func NewChunkManager(downloadManager *DownloadManager, chunkPath string, chunkSi
 	}
 
 	manager := ChunkManager{
-		ChunkPath:       chunkPath,
-		ChunkSize:       chunkSize,
-		downloadManager: downloadManager,
+		ChunkSize:         chunkSize,
+		MaxCacheSize:      maxCacheSize,
+		PreloadWindowSize: 2,
+		PreloadThreshold:  2,
+		store:             store,
+		downloadManager:   downloadManager,
+		cacheIndex:        make(map[string]*chunkCacheEntry),
+		pinned:            make(map[string]int),
+		patterns:          make(map[string]*readerPattern),
+		preloading:        make(map[string]bool),
+		inflight:          make(map[string]*sharedChunkOp),
+	}
+
+	if err := manager.rebuildCacheIndex(); nil != err {
+		Log.Warningf("Could not rebuild chunk cache index: %v", err)
 	}
 
 	return &manager, nil
 }
 
+// rebuildCacheIndex walks the store on startup and restores the in-memory
+// index (and total size) of chunks that are already cached
+func (m *ChunkManager) rebuildCacheIndex() error {
+	return m.store.Walk(func(entry ChunkStoreEntry) error {
+		m.cacheIndex[entry.ID] = &chunkCacheEntry{
+			size:  entry.Size,
+			mtime: entry.MTime,
+		}
+		m.cacheSize += entry.Size
+
+		return nil
+	})
+}
+
+// Stats returns a snapshot of the current cache accounting counters
+func (m *ChunkManager) Stats() ChunkManagerStats {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
+	return m.stats
+}
+
+func (m *ChunkManager) pin(id string) {
+	m.cacheMu.Lock()
+	m.pinned[id]++
+	m.cacheMu.Unlock()
+}
+
+func (m *ChunkManager) unpin(id string) {
+	m.cacheMu.Lock()
+	m.pinned[id]--
+	if m.pinned[id] <= 0 {
+		delete(m.pinned, id)
+	}
+	m.cacheMu.Unlock()
+}
+
+// ensureSpace evicts the least-recently-used, unpinned chunks until there is
+// enough room for an additional `needed` bytes, or nothing more can be evicted
+func (m *ChunkManager) ensureSpace(needed int64) {
+	if m.MaxCacheSize <= 0 {
+		return
+	}
+
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
+	if m.cacheSize+needed <= m.MaxCacheSize {
+		return
+	}
+
+	entries := make([]string, 0, len(m.cacheIndex))
+	for key := range m.cacheIndex {
+		if m.pinned[key] > 0 {
+			continue
+		}
+		entries = append(entries, key)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return m.cacheIndex[entries[i]].mtime.Before(m.cacheIndex[entries[j]].mtime)
+	})
+
+	for _, key := range entries {
+		if m.cacheSize+needed <= m.MaxCacheSize {
+			break
+		}
+
+		entry := m.cacheIndex[key]
+		if err := m.store.Delete(key); nil != err {
+			Log.Warningf("Could not evict chunk %v: %v", key, err)
+			continue
+		}
+
+		m.cacheSize -= entry.size
+		delete(m.cacheIndex, key)
+		m.stats.Evictions++
+	}
+}
+
 func (m *ChunkManager) RequestChunk(req *ChunkRequest) <-chan *ChunkResponse {
 	res := make(chan *ChunkResponse)
 
@@ -68,23 +215,27 @@ func (m *ChunkManager) RequestChunk(req *ChunkRequest) <-chan *ChunkResponse {
 		req.offsetEnd = req.offsetStart + m.ChunkSize
 		req.id = fmt.Sprintf("%v:%v", req.Object.ObjectID, req.offsetStart)
 
-		diskRes := m.loadChunkFromDisk(req)
-		if nil != diskRes.Error {
-			Log.Debugf("%v", diskRes.Error)
-		} else {
-			res <- diskRes
+		m.pin(req.id)
+		defer m.unpin(req.id)
+
+		if !req.Preload && m.isSequential(req) {
+			go m.preloadAhead(req)
 		}
 
-		apiRes := m.downloadManager.RequestChunk(req)
+		if diskRes := m.loadChunk(req); nil == diskRes.Error {
+			// cache hit: serve straight from the store, the downloader is
+			// never involved and nothing is rewritten to disk
+			res <- diskRes
+			return
+		}
 
+		apiRes := m.fetchChunk(req)
 		if nil == apiRes.Error {
 			sOffset := int64(math.Min(float64(req.fOffset), float64(len(apiRes.Bytes))))
 			eOffset := int64(math.Min(float64(req.fOffset+req.Size), float64(len(apiRes.Bytes))))
 			res <- &ChunkResponse{
 				Bytes: apiRes.Bytes[sOffset:eOffset],
 			}
-
-			m.storeChunkToDisk(req, apiRes)
 		} else {
 			res <- apiRes
 		}
@@ -93,56 +244,203 @@ func (m *ChunkManager) RequestChunk(req *ChunkRequest) <-chan *ChunkResponse {
 	return res
 }
 
-func (m *ChunkManager) loadChunkFromDisk(req *ChunkRequest) *ChunkResponse {
-	chunkDir := filepath.Join(m.ChunkPath, req.Object.ObjectID)
-	filename := filepath.Join(chunkDir, strconv.Itoa(int(req.offsetStart)))
+// fetchChunk downloads req, coalescing concurrent misses for the same chunk
+// id behind a single download: the first caller performs the request and
+// stores the result, everyone else waits on that same result.
+func (m *ChunkManager) fetchChunk(req *ChunkRequest) *ChunkResponse {
+	m.sfMu.Lock()
+	if op, ok := m.inflight[req.id]; ok {
+		m.sfMu.Unlock()
+		<-op.done
+		return op.res
+	}
+
+	op := &sharedChunkOp{done: make(chan struct{})}
+	m.inflight[req.id] = op
+	m.sfMu.Unlock()
+
+	op.res = m.downloadManager.RequestChunk(req)
+	if nil == op.res.Error {
+		m.storeChunk(req, op.res)
+	}
+
+	m.sfMu.Lock()
+	delete(m.inflight, req.id)
+	m.sfMu.Unlock()
+	close(op.done)
 
-	f, err := os.Open(filename)
+	return op.res
+}
+
+func (m *ChunkManager) loadChunk(req *ChunkRequest) *ChunkResponse {
+	data, err := m.store.Get(req.id, req.fOffset, req.Size)
 	if nil != err {
 		Log.Tracef("%v", err)
+		m.cacheMu.Lock()
+		m.stats.Misses++
+		m.cacheMu.Unlock()
 		return &ChunkResponse{
-			Error: fmt.Errorf("Could not open file %v", filename),
+			Error: fmt.Errorf("Could not read chunk %v at %v: %v", req.id, req.fOffset, err),
 		}
 	}
-	defer f.Close()
 
-	buf := make([]byte, req.Size)
-	n, err := f.ReadAt(buf, req.fOffset)
-	if n > 0 && (nil == err || io.EOF == err || io.ErrUnexpectedEOF == err) {
-		Log.Tracef("Found file %s bytes %v - %v in cache", filename, req.offsetStart, req.offsetEnd)
+	Log.Tracef("Found chunk %s bytes %v - %v in cache", req.id, req.offsetStart, req.offsetEnd)
 
-		// update the last modified time for files that are often in use
-		if err := os.Chtimes(filename, time.Now(), time.Now()); nil != err {
-			Log.Warningf("Could not update last modified time for %v", filename)
-		}
+	mtime := time.Now()
+	m.cacheMu.Lock()
+	if entry, ok := m.cacheIndex[req.id]; ok {
+		entry.mtime = mtime
+	}
+	m.stats.Hits++
+	m.cacheMu.Unlock()
 
-		eOffset := int64(math.Min(float64(req.Size), float64(len(buf))))
-		return &ChunkResponse{
-			Bytes: buf[:eOffset],
+	return &ChunkResponse{
+		Bytes: data,
+	}
+}
+
+func (m *ChunkManager) storeChunk(req *ChunkRequest, res *ChunkResponse) {
+	if m.isCached(req.id) {
+		return
+	}
+
+	m.ensureSpace(int64(len(res.Bytes)))
+
+	if err := m.store.Put(req.id, res.Bytes); nil != err {
+		Log.Debugf("%v", err)
+		Log.Warningf("Could not store chunk %v", req.id)
+		return
+	}
+
+	mtime := time.Now()
+	m.cacheMu.Lock()
+	m.cacheIndex[req.id] = &chunkCacheEntry{
+		size:  int64(len(res.Bytes)),
+		mtime: mtime,
+	}
+	m.cacheSize += int64(len(res.Bytes))
+	m.stats.Bytes += int64(len(res.Bytes))
+	m.cacheMu.Unlock()
+}
+
+// isPinned reports whether a chunk is currently in use by an in-flight request
+func (m *ChunkManager) isPinned(id string) bool {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
+	return m.pinned[id] > 0
+}
+
+// isCached reports whether a chunk is already present in the store, without
+// affecting hit/miss accounting.
+func (m *ChunkManager) isCached(id string) bool {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
+	_, ok := m.cacheIndex[id]
+	return ok
+}
+
+// isSequential records the requested offset for req.Object and reports
+// whether access to this object currently looks sequential, in which case
+// the caller should read ahead. A run of PreloadThreshold consecutive chunk
+// requests advancing by exactly ChunkSize is considered sequential; any gap
+// or rewind resets the counter and is treated as random access.
+func (m *ChunkManager) isSequential(req *ChunkRequest) bool {
+	m.patternMu.Lock()
+	defer m.patternMu.Unlock()
+
+	pattern, ok := m.patterns[req.Object.ObjectID]
+	if !ok {
+		if len(m.patterns) >= maxTrackedPatterns {
+			m.evictOldestPatternLocked()
 		}
+		pattern = &readerPattern{}
+		m.patterns[req.Object.ObjectID] = pattern
 	}
 
-	Log.Tracef("%v", err)
-	return &ChunkResponse{
-		Error: fmt.Errorf("Could not read file %s at %v", filename, req.fOffset),
+	if pattern.hasLastOffset && req.offsetStart == pattern.lastOffsetStart+m.ChunkSize {
+		pattern.sequentialHits++
+	} else {
+		pattern.sequentialHits = 0
 	}
+	pattern.lastOffsetStart = req.offsetStart
+	pattern.hasLastOffset = true
+	pattern.lastAccess = time.Now()
+
+	return pattern.sequentialHits >= m.PreloadThreshold
 }
 
-func (m *ChunkManager) storeChunkToDisk(req *ChunkRequest, res *ChunkResponse) {
-	chunkDir := filepath.Join(m.ChunkPath, req.Object.ObjectID)
-	filename := filepath.Join(chunkDir, strconv.Itoa(int(req.offsetStart)))
+// evictOldestPatternLocked removes the least recently accessed reader
+// pattern entry. Callers must hold patternMu.
+func (m *ChunkManager) evictOldestPatternLocked() {
+	var oldestKey string
+	var oldestAccess time.Time
 
-	if _, err := os.Stat(chunkDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(chunkDir, 0777); nil != err {
-			Log.Debugf("%v", err)
-			Log.Warningf("Could not create chunk temp path %v", chunkDir)
+	for key, pattern := range m.patterns {
+		if "" == oldestKey || pattern.lastAccess.Before(oldestAccess) {
+			oldestKey = key
+			oldestAccess = pattern.lastAccess
 		}
 	}
 
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		if err := ioutil.WriteFile(filename, res.Bytes, 0777); nil != err {
-			Log.Debugf("%v", err)
-			Log.Warningf("Could not write chunk temp file %v", filename)
+	if "" != oldestKey {
+		delete(m.patterns, oldestKey)
+	}
+}
+
+// preloadAhead fetches the next PreloadWindowSize chunks following req, one
+// after another, so they are already cached by the time the FUSE layer asks
+// for them; RequestChunk runs it in its own goroutine. Chunks that are already cached or already being fetched are
+// skipped to avoid wasting bandwidth and duplicating in-flight downloads.
+func (m *ChunkManager) preloadAhead(req *ChunkRequest) {
+	for i := 1; i <= m.PreloadWindowSize; i++ {
+		offsetStart := req.offsetStart + int64(i)*m.ChunkSize
+		id := fmt.Sprintf("%v:%v", req.Object.ObjectID, offsetStart)
+
+		if m.isCached(id) {
+			continue
 		}
+		if !m.startPreload(id) {
+			continue
+		}
+
+		preloadReq := &ChunkRequest{
+			Object:      req.Object,
+			Offset:      offsetStart,
+			Size:        m.ChunkSize,
+			Preload:     true,
+			id:          id,
+			offsetStart: offsetStart,
+			offsetEnd:   offsetStart + m.ChunkSize,
+		}
+
+		m.pin(id)
+		apiRes := m.fetchChunk(preloadReq)
+		if nil != apiRes.Error {
+			Log.Debugf("Could not preload chunk %v: %v", id, apiRes.Error)
+		}
+		m.unpin(id)
+		m.finishPreload(id)
+	}
+}
+
+// startPreload marks a chunk as being preloaded, returning false if it is
+// already pinned by another in-flight request or already being preloaded.
+func (m *ChunkManager) startPreload(id string) bool {
+	m.preloadMu.Lock()
+	defer m.preloadMu.Unlock()
+
+	if m.preloading[id] || m.isPinned(id) {
+		return false
 	}
+	m.preloading[id] = true
+
+	return true
+}
+
+func (m *ChunkManager) finishPreload(id string) {
+	m.preloadMu.Lock()
+	delete(m.preloading, id)
+	m.preloadMu.Unlock()
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+type noopDownloader struct{}
+
+func (noopDownloader) RequestChunk(req *ChunkRequest) *ChunkResponse {
+	return &ChunkResponse{Error: nil, Bytes: nil}
+}
+
+func TestEnsureSpaceEvictsLRUButSparesPinned(t *testing.T) {
+	m, err := NewChunkManager(noopDownloader{}, NewMemoryChunkStore(), 4096, 12)
+	if nil != err {
+		t.Fatalf("NewChunkManager failed: %v", err)
+	}
+
+	// store three 4-byte chunks, oldest first; cap is 12 bytes so they just fit
+	put := func(id string, data []byte) {
+		m.storeChunk(&ChunkRequest{id: id}, &ChunkResponse{Bytes: data})
+	}
+
+	put("object-1:0", []byte("aaaa"))
+	put("object-1:4096", []byte("bbbb"))
+	put("object-1:8192", []byte("cccc"))
+
+	// pin the oldest entry, as if a read were still in flight for it
+	m.pin("object-1:0")
+	defer m.unpin("object-1:0")
+
+	// forcing room for one more chunk should evict the oldest *unpinned* entry
+	// (object-1:4096), not the pinned one
+	m.ensureSpace(4)
+
+	if !m.isCached("object-1:0") {
+		t.Fatalf("pinned chunk object-1:0 was evicted, but must not be")
+	}
+	if m.isCached("object-1:4096") {
+		t.Fatalf("expected the oldest unpinned chunk object-1:4096 to be evicted")
+	}
+	if !m.isCached("object-1:8192") {
+		t.Fatalf("expected the newest chunk object-1:8192 to survive eviction")
+	}
+
+	if _, err := m.store.Size("object-1:4096"); err != ErrChunkNotFound {
+		t.Fatalf("expected evicted chunk to be removed from the store, err=%v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// chunkCipherMagic/chunkCipherVersion identify the on-disk header of an
+// encrypted chunk: magic(4) || version(1) || nonce(12) || ciphertext || tag(16)
+var chunkCipherMagic = [4]byte{'P', 'D', 'C', '1'}
+
+const (
+	chunkCipherVersion = 1
+	chunkCipherKeyInfo = "plexdrive-chunk-v1"
+	chunkCipherKeySize = 32 // AES-256
+)
+
+// EncryptedChunkStore wraps another ChunkStore and transparently encrypts
+// every chunk with AES-GCM before it reaches the underlying store, using a
+// key derived per-object from a master passphrase via HKDF-SHA256. This keeps
+// cached chunk files unreadable to anyone else with access to the same disk.
+type EncryptedChunkStore struct {
+	underlying ChunkStore
+	passphrase []byte
+}
+
+// NewEncryptedChunkStore wraps underlying with AES-GCM encryption driven by
+// passphrase. passphrase is kept only in memory for the lifetime of the store.
+func NewEncryptedChunkStore(underlying ChunkStore, passphrase []byte) (*EncryptedChunkStore, error) {
+	if nil == underlying {
+		return nil, fmt.Errorf("Underlying chunk store must not be nil")
+	}
+	if 0 == len(passphrase) {
+		return nil, fmt.Errorf("Cache passphrase must not be empty")
+	}
+
+	return &EncryptedChunkStore{
+		underlying: underlying,
+		passphrase: passphrase,
+	}, nil
+}
+
+// ReadPassphraseFile reads and trims a passphrase file for use with
+// NewEncryptedChunkStore (the --cache-passphrase-file flag)
+func ReadPassphraseFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil, fmt.Errorf("Could not read cache passphrase file %v: %v", path, err)
+	}
+
+	return bytes.TrimRight(data, "\r\n"), nil
+}
+
+func (s *EncryptedChunkStore) deriveKey(objectID string) ([]byte, error) {
+	kdf := hkdf.New(sha256.New, s.passphrase, []byte(objectID), []byte(chunkCipherKeyInfo))
+
+	key := make([]byte, chunkCipherKeySize)
+	if _, err := io.ReadFull(kdf, key); nil != err {
+		return nil, fmt.Errorf("Could not derive chunk key: %v", err)
+	}
+
+	return key, nil
+}
+
+func (s *EncryptedChunkStore) gcmFor(objectID string) (cipher.AEAD, error) {
+	key, err := s.deriveKey(objectID)
+	if nil != err {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		return nil, fmt.Errorf("Could not create cipher: %v", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (s *EncryptedChunkStore) encrypt(objectID string, plaintext []byte) ([]byte, error) {
+	gcm, err := s.gcmFor(objectID)
+	if nil != err {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); nil != err {
+		return nil, fmt.Errorf("Could not generate nonce: %v", err)
+	}
+
+	out := make([]byte, 0, len(chunkCipherMagic)+1+len(nonce)+len(plaintext)+gcm.Overhead())
+	out = append(out, chunkCipherMagic[:]...)
+	out = append(out, chunkCipherVersion)
+	out = append(out, nonce...)
+	out = gcm.Seal(out, nonce, plaintext, nil)
+
+	return out, nil
+}
+
+func (s *EncryptedChunkStore) decrypt(objectID string, data []byte) ([]byte, error) {
+	headerLen := len(chunkCipherMagic) + 1
+	if len(data) < headerLen || !bytes.Equal(data[:len(chunkCipherMagic)], chunkCipherMagic[:]) {
+		return nil, fmt.Errorf("chunk is missing the expected encryption header")
+	}
+	if data[len(chunkCipherMagic)] != chunkCipherVersion {
+		return nil, fmt.Errorf("unsupported chunk encryption version %v", data[len(chunkCipherMagic)])
+	}
+
+	gcm, err := s.gcmFor(objectID)
+	if nil != err {
+		return nil, err
+	}
+
+	nonceEnd := headerLen + gcm.NonceSize()
+	if len(data) < nonceEnd {
+		return nil, fmt.Errorf("chunk is too short to contain a nonce")
+	}
+	nonce := data[headerLen:nonceEnd]
+	ciphertext := data[nonceEnd:]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if nil != err {
+		return nil, fmt.Errorf("chunk failed authentication: %v", err)
+	}
+
+	return plaintext, nil
+}
+
+func (s *EncryptedChunkStore) Get(id string, offset, size int64) ([]byte, error) {
+	objectID, _, err := splitChunkID(id)
+	if nil != err {
+		return nil, err
+	}
+
+	rawSize, err := s.underlying.Size(id)
+	if nil != err {
+		return nil, err
+	}
+
+	raw, err := s.underlying.Get(id, 0, rawSize)
+	if nil != err {
+		return nil, err
+	}
+
+	plaintext, err := s.decrypt(objectID, raw)
+	if nil != err {
+		// corrupted or foreign chunk file; evict it so it can't poison the cache
+		if delErr := s.underlying.Delete(id); nil != delErr {
+			return nil, fmt.Errorf("%v (and could not evict: %v)", err, delErr)
+		}
+		return nil, err
+	}
+
+	end := offset + size
+	if end > int64(len(plaintext)) {
+		end = int64(len(plaintext))
+	}
+	if offset > end {
+		offset = end
+	}
+
+	return plaintext[offset:end], nil
+}
+
+func (s *EncryptedChunkStore) Put(id string, data []byte) error {
+	objectID, _, err := splitChunkID(id)
+	if nil != err {
+		return err
+	}
+
+	ciphertext, err := s.encrypt(objectID, data)
+	if nil != err {
+		return err
+	}
+
+	return s.underlying.Put(id, ciphertext)
+}
+
+func (s *EncryptedChunkStore) Delete(id string) error {
+	return s.underlying.Delete(id)
+}
+
+// Size returns the on-disk (ciphertext) size of the chunk, which is the
+// plaintext size plus the fixed header/nonce/tag overhead.
+func (s *EncryptedChunkStore) Size(id string) (int64, error) {
+	return s.underlying.Size(id)
+}
+
+func (s *EncryptedChunkStore) Walk(fn func(entry ChunkStoreEntry) error) error {
+	return s.underlying.Walk(fn)
+}
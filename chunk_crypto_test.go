@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptedChunkStoreRoundTrip(t *testing.T) {
+	store, err := NewEncryptedChunkStore(NewMemoryChunkStore(), []byte("correct horse battery staple"))
+	if nil != err {
+		t.Fatalf("NewEncryptedChunkStore failed: %v", err)
+	}
+
+	id := "object-1:0"
+	want := []byte("the quick brown fox jumps over the lazy dog")
+
+	if err := store.Put(id, want); nil != err {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	got, err := store.Get(id, 0, int64(len(want)))
+	if nil != err {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("round trip mismatch: got %q, want %q", got, want)
+	}
+
+	// a partial read should return the requested slice of the plaintext
+	got, err = store.Get(id, 4, 5)
+	if nil != err {
+		t.Fatalf("partial Get failed: %v", err)
+	}
+	if !bytes.Equal(got, want[4:9]) {
+		t.Fatalf("partial round trip mismatch: got %q, want %q", got, want[4:9])
+	}
+}
+
+func TestEncryptedChunkStoreRejectsTamperedCiphertext(t *testing.T) {
+	underlying := NewMemoryChunkStore()
+	store, err := NewEncryptedChunkStore(underlying, []byte("correct horse battery staple"))
+	if nil != err {
+		t.Fatalf("NewEncryptedChunkStore failed: %v", err)
+	}
+
+	id := "object-1:0"
+	if err := store.Put(id, []byte("hello, world")); nil != err {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	raw, err := underlying.Get(id, 0, 1<<16)
+	if nil != err {
+		t.Fatalf("could not read back raw ciphertext: %v", err)
+	}
+	tampered := make([]byte, len(raw))
+	copy(tampered, raw)
+	tampered[len(tampered)-1] ^= 0xFF
+	if err := underlying.Delete(id); nil != err {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := underlying.Put(id, tampered); nil != err {
+		t.Fatalf("Put tampered data failed: %v", err)
+	}
+
+	if _, err := store.Get(id, 0, 5); nil == err {
+		t.Fatalf("expected tampered chunk to be rejected, got no error")
+	}
+
+	// the corrupted chunk must be evicted so it can't keep poisoning the cache
+	if _, err := underlying.Size(id); err != ErrChunkNotFound {
+		t.Fatalf("expected tampered chunk to be evicted, got err=%v", err)
+	}
+}
+
+func TestEncryptedChunkStoreRejectsWrongObjectKey(t *testing.T) {
+	underlying := NewMemoryChunkStore()
+	store, err := NewEncryptedChunkStore(underlying, []byte("correct horse battery staple"))
+	if nil != err {
+		t.Fatalf("NewEncryptedChunkStore failed: %v", err)
+	}
+
+	if err := store.Put("object-1:0", []byte("hello, world")); nil != err {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// move the ciphertext under a different object id: the derived key
+	// differs (salt = ObjectID), so decryption must fail rather than return
+	// garbage or content encrypted for a different object
+	raw, err := underlying.Get("object-1:0", 0, 1<<16)
+	if nil != err {
+		t.Fatalf("could not read back raw ciphertext: %v", err)
+	}
+	if err := underlying.Put("object-2:0", raw); nil != err {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	if _, err := store.Get("object-2:0", 0, 5); nil == err {
+		t.Fatalf("expected chunk encrypted under a different object id to be rejected")
+	}
+}
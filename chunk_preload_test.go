@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// countingDownloader records every distinct chunk id it was asked to fetch,
+// so a test can assert which ids preloadAhead actually reaches for.
+type countingDownloader struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (d *countingDownloader) RequestChunk(req *ChunkRequest) *ChunkResponse {
+	d.mu.Lock()
+	d.ids = append(d.ids, req.id)
+	d.mu.Unlock()
+
+	return &ChunkResponse{Bytes: make([]byte, req.Size)}
+}
+
+func (d *countingDownloader) requestedIDs() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	out := make([]string, len(d.ids))
+	copy(out, d.ids)
+	return out
+}
+
+func TestIsSequentialDetectsRunAndTriggersPreload(t *testing.T) {
+	downloader := &countingDownloader{}
+	m, err := NewChunkManager(downloader, NewMemoryChunkStore(), 4096, 0)
+	if nil != err {
+		t.Fatalf("NewChunkManager failed: %v", err)
+	}
+
+	obj := &APIObject{ObjectID: "object-1"}
+
+	seq := func(offsetStart int64) bool {
+		return m.isSequential(&ChunkRequest{Object: obj, offsetStart: offsetStart})
+	}
+
+	if seq(0) {
+		t.Fatalf("first access must not look sequential yet")
+	}
+	if seq(4096) {
+		t.Fatalf("second consecutive access must not look sequential yet")
+	}
+	if !seq(8192) {
+		t.Fatalf("a third consecutive chunk-aligned access should be detected as sequential")
+	}
+	if seq(0) {
+		t.Fatalf("a rewind must reset the sequential run")
+	}
+
+	// preloadAhead should fetch the PreloadWindowSize chunks following req,
+	// skipping any that are already cached so it doesn't duplicate work.
+	m.storeChunk(&ChunkRequest{id: "object-1:16384"}, &ChunkResponse{Bytes: make([]byte, 4096)})
+
+	m.preloadAhead(&ChunkRequest{Object: obj, offsetStart: 8192})
+
+	got := downloader.requestedIDs()
+	if len(got) != 1 || got[0] != "object-1:12288" {
+		t.Fatalf("expected preloadAhead to fetch only the uncached chunk object-1:12288, got %v", got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingDownloader counts how many times RequestChunk is invoked and lets
+// the test control exactly when the "download" completes, so concurrent
+// callers can be made to overlap deterministically.
+type blockingDownloader struct {
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+	res     *ChunkResponse
+}
+
+func newBlockingDownloader(res *ChunkResponse) *blockingDownloader {
+	return &blockingDownloader{
+		started: make(chan struct{}, 16),
+		release: make(chan struct{}),
+		res:     res,
+	}
+}
+
+func (d *blockingDownloader) RequestChunk(req *ChunkRequest) *ChunkResponse {
+	atomic.AddInt32(&d.calls, 1)
+	d.started <- struct{}{}
+	<-d.release
+	return d.res
+}
+
+func TestFetchChunkSingleFlight(t *testing.T) {
+	downloader := newBlockingDownloader(&ChunkResponse{Bytes: []byte("chunk-bytes")})
+
+	m, err := NewChunkManager(downloader, NewMemoryChunkStore(), 4096, 0)
+	if nil != err {
+		t.Fatalf("NewChunkManager failed: %v", err)
+	}
+
+	req := &ChunkRequest{
+		id: "object-1:0",
+	}
+
+	const callers = 8
+	var wg sync.WaitGroup
+	results := make([]*ChunkResponse, callers)
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = m.fetchChunk(req)
+		}(i)
+	}
+
+	select {
+	case <-downloader.started:
+	case <-time.After(time.Second):
+		t.Fatalf("downloader was never invoked")
+	}
+
+	// give any (buggy) extra callers a chance to also reach the downloader
+	// before we release it
+	time.Sleep(20 * time.Millisecond)
+	close(downloader.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&downloader.calls); calls != 1 {
+		t.Fatalf("expected exactly 1 download for %d concurrent misses, got %d", callers, calls)
+	}
+
+	for i, res := range results {
+		if nil == res || nil != res.Error {
+			t.Fatalf("caller %d got unexpected error: %v", i, res)
+		}
+		if string(res.Bytes) != "chunk-bytes" {
+			t.Fatalf("caller %d got unexpected bytes: %q", i, res.Bytes)
+		}
+	}
+}
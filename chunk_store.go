@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	. "github.com/claudetech/loggo/default"
+)
+
+// ErrChunkNotFound is returned by a ChunkStore when the requested chunk does
+// not exist
+var ErrChunkNotFound = errors.New("chunk not found in store")
+
+// ChunkStoreEntry describes a single chunk as seen by ChunkStore.Walk, used
+// by ChunkManager to rebuild its in-memory cache index on startup
+type ChunkStoreEntry struct {
+	ID    string
+	Size  int64
+	MTime time.Time
+}
+
+// ChunkStore persists full, ChunkSize-aligned chunks identified by a
+// "objectID:offsetStart" id. Implementations back the chunk cache with
+// different media (disk, memory, object storage) without ChunkManager
+// needing to know the difference.
+type ChunkStore interface {
+	// Get returns the `size` bytes starting at `offset` within the chunk
+	// identified by id. It returns ErrChunkNotFound if the chunk is not
+	// present in the store.
+	Get(id string, offset, size int64) ([]byte, error)
+	// Put stores the full content of the chunk identified by id. Implementations
+	// must not overwrite an existing chunk with the same id.
+	Put(id string, data []byte) error
+	// Delete removes the chunk identified by id, if present.
+	Delete(id string) error
+	// Size returns the stored size of the chunk identified by id, without
+	// reading its content. It returns ErrChunkNotFound if the chunk is not
+	// present in the store.
+	Size(id string) (int64, error)
+	// Walk calls fn once for every chunk currently in the store, used to
+	// rebuild the cache index on startup.
+	Walk(fn func(entry ChunkStoreEntry) error) error
+}
+
+// splitChunkID splits a "objectID:offsetStart" chunk id into its parts
+func splitChunkID(id string) (objectID string, offsetStart string, err error) {
+	idx := strings.LastIndex(id, ":")
+	if idx < 0 {
+		return "", "", fmt.Errorf("Invalid chunk id %v", id)
+	}
+	return id[:idx], id[idx+1:], nil
+}
+
+// FileChunkStore persists chunks as plain files on disk, one per chunk, laid
+// out as ChunkPath/objectID/offsetStart. This is the original, default store.
+type FileChunkStore struct {
+	ChunkPath string
+}
+
+// NewFileChunkStore creates a new disk-backed chunk store rooted at chunkPath
+func NewFileChunkStore(chunkPath string) (*FileChunkStore, error) {
+	if "" == chunkPath {
+		return nil, fmt.Errorf("Path to chunk file must not be empty")
+	}
+
+	return &FileChunkStore{ChunkPath: chunkPath}, nil
+}
+
+func (s *FileChunkStore) filename(id string) (string, error) {
+	objectID, offsetStart, err := splitChunkID(id)
+	if nil != err {
+		return "", err
+	}
+	return filepath.Join(s.ChunkPath, objectID, offsetStart), nil
+}
+
+func (s *FileChunkStore) Get(id string, offset, size int64) ([]byte, error) {
+	filename, err := s.filename(id)
+	if nil != err {
+		return nil, err
+	}
+
+	f, err := os.Open(filename)
+	if nil != err {
+		return nil, ErrChunkNotFound
+	}
+	defer f.Close()
+
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, offset)
+	if n > 0 && (nil == err || io.EOF == err || io.ErrUnexpectedEOF == err) {
+		mtime := time.Now()
+		if err := os.Chtimes(filename, mtime, mtime); nil != err {
+			Log.Warningf("Could not update last modified time for %v", filename)
+		}
+		return buf[:n], nil
+	}
+
+	return nil, ErrChunkNotFound
+}
+
+func (s *FileChunkStore) Put(id string, data []byte) error {
+	filename, err := s.filename(id)
+	if nil != err {
+		return err
+	}
+
+	chunkDir := filepath.Dir(filename)
+	if _, err := os.Stat(chunkDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(chunkDir, 0777); nil != err {
+			return fmt.Errorf("Could not create chunk temp path %v: %v", chunkDir, err)
+		}
+	}
+
+	if _, err := os.Stat(filename); nil == err {
+		return nil
+	}
+
+	return ioutil.WriteFile(filename, data, 0777)
+}
+
+func (s *FileChunkStore) Delete(id string) error {
+	filename, err := s.filename(id)
+	if nil != err {
+		return err
+	}
+	if err := os.Remove(filename); nil != err && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileChunkStore) Size(id string) (int64, error) {
+	filename, err := s.filename(id)
+	if nil != err {
+		return 0, err
+	}
+
+	info, err := os.Stat(filename)
+	if nil != err {
+		return 0, ErrChunkNotFound
+	}
+
+	return info.Size(), nil
+}
+
+func (s *FileChunkStore) Walk(fn func(entry ChunkStoreEntry) error) error {
+	if _, err := os.Stat(s.ChunkPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(s.ChunkPath, func(path string, info os.FileInfo, err error) error {
+		if nil != err {
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		objectID := filepath.Base(filepath.Dir(path))
+		offsetStart := filepath.Base(path)
+		if _, err := strconv.ParseInt(offsetStart, 10, 64); nil != err {
+			return nil
+		}
+
+		return fn(ChunkStoreEntry{
+			ID:    fmt.Sprintf("%v:%v", objectID, offsetStart),
+			Size:  info.Size(),
+			MTime: info.ModTime(),
+		})
+	})
+}
+
+// MemoryChunkStore keeps chunks in RAM only, useful on setups (e.g.
+// Raspberry-Pi-like devices) where repeated writes to an SD card are
+// undesirable. Eviction is left to ChunkManager; this store just holds bytes.
+type MemoryChunkStore struct {
+	mu     sync.Mutex
+	chunks map[string][]byte
+	mtimes map[string]time.Time
+}
+
+// NewMemoryChunkStore creates a new in-memory chunk store. Eviction is not
+// this store's concern: ChunkManager tracks size and mtime itself (via Walk
+// and its own cacheIndex) and evicts the same way regardless of backend.
+func NewMemoryChunkStore() *MemoryChunkStore {
+	return &MemoryChunkStore{
+		chunks: make(map[string][]byte),
+		mtimes: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryChunkStore) Get(id string, offset, size int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.chunks[id]
+	if !ok {
+		return nil, ErrChunkNotFound
+	}
+
+	s.mtimes[id] = time.Now()
+
+	end := offset + size
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	if offset > end {
+		offset = end
+	}
+
+	return data[offset:end], nil
+}
+
+func (s *MemoryChunkStore) Put(id string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.chunks[id]; ok {
+		return nil
+	}
+
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	s.chunks[id] = cp
+	s.mtimes[id] = time.Now()
+
+	return nil
+}
+
+func (s *MemoryChunkStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.chunks, id)
+	delete(s.mtimes, id)
+
+	return nil
+}
+
+func (s *MemoryChunkStore) Size(id string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.chunks[id]
+	if !ok {
+		return 0, ErrChunkNotFound
+	}
+
+	return int64(len(data)), nil
+}
+
+func (s *MemoryChunkStore) Walk(fn func(entry ChunkStoreEntry) error) error {
+	s.mu.Lock()
+	entries := make([]ChunkStoreEntry, 0, len(s.chunks))
+	for id, data := range s.chunks {
+		entries = append(entries, ChunkStoreEntry{
+			ID:    id,
+			Size:  int64(len(data)),
+			MTime: s.mtimes[id],
+		})
+	}
+	s.mu.Unlock()
+
+	for _, entry := range entries {
+		if err := fn(entry); nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// S3ChunkStore persists chunks in an S3-compatible object store (AWS S3 or
+// MinIO), allowing multiple plexdrive instances to share a single warm cache.
+type S3ChunkStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3ChunkStore creates a new S3-backed chunk store for the given bucket.
+// The endpoint (AWS S3 or a MinIO/S3-compatible server) is whatever client is
+// configured for; objects are stored under prefix, if it is not empty.
+func NewS3ChunkStore(client *s3.Client, bucket, prefix string) (*S3ChunkStore, error) {
+	if "" == bucket {
+		return nil, fmt.Errorf("S3 chunk store bucket must not be empty")
+	}
+
+	return &S3ChunkStore{
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+	}, nil
+}
+
+func (s *S3ChunkStore) key(id string) string {
+	if "" == s.prefix {
+		return id
+	}
+	return s.prefix + "/" + id
+}
+
+func (s *S3ChunkStore) Get(id string, offset, size int64) ([]byte, error) {
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)
+
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+		Range:  aws.String(rangeHeader),
+	})
+	if nil != err {
+		return nil, ErrChunkNotFound
+	}
+	defer out.Body.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(out.Body); nil != err {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *S3ChunkStore) Put(id string, data []byte) error {
+	if _, err := s.Size(id); nil == err {
+		return nil
+	}
+
+	_, err := s.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (s *S3ChunkStore) Delete(id string) error {
+	_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	return err
+}
+
+func (s *S3ChunkStore) Size(id string) (int64, error) {
+	out, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if nil != err {
+		return 0, ErrChunkNotFound
+	}
+
+	return aws.ToInt64(out.ContentLength), nil
+}
+
+func (s *S3ChunkStore) Walk(fn func(entry ChunkStoreEntry) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if nil != err {
+			return err
+		}
+
+		for _, obj := range page.Contents {
+			id := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix+"/")
+			if err := fn(ChunkStoreEntry{
+				ID:    id,
+				Size:  aws.ToInt64(obj.Size),
+				MTime: aws.ToTime(obj.LastModified),
+			}); nil != err {
+				return err
+			}
+		}
+	}
+
+	return nil
+}